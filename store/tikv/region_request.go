@@ -14,6 +14,8 @@
 package tikv
 
 import (
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/juju/errors"
@@ -25,6 +27,52 @@ import (
 	"google.golang.org/grpc/codes"
 )
 
+// ReplicaReadType is the type of replica to serve a read-only request, such as
+// Get/BatchGet/Scan/Cop. It is carried on tikvrpc.Request so that RegionCache
+// knows which peer is eligible to be picked in GetRPCContext.
+type ReplicaReadType byte
+
+const (
+	// ReplicaReadLeader can only send requests to the leader peer.
+	ReplicaReadLeader ReplicaReadType = iota
+	// ReplicaReadFollower can only send requests to follower peers.
+	ReplicaReadFollower
+	// ReplicaReadMixed can send requests to the leader or a follower peer.
+	ReplicaReadMixed
+	// ReplicaReadPreferLeader prefers the leader peer, and only considers
+	// followers when the leader is unavailable or busy.
+	ReplicaReadPreferLeader
+)
+
+// Stale-read counters. An approximate count is good enough for monitoring, so
+// they are updated without any locking.
+var (
+	staleReadHitCounter      int64
+	staleReadFallbackCounter int64
+)
+
+// StaleReadCounters returns the cumulative number of stale reads served
+// directly from a follower (hit) and the number that instead fell back to
+// the leader because the replica's safe-ts had not caught up with ReadTS
+// (fallback), so operators can monitor the stale-read hit/fallback ratio.
+// The counts are process-wide and approximate; see the var block above.
+func StaleReadCounters() (hit, fallback int64) {
+	return atomic.LoadInt64(&staleReadHitCounter), atomic.LoadInt64(&staleReadFallbackCounter)
+}
+
+// StoreLabel is a key/value locality label (e.g. zone, rack, host) attached
+// to a TiKV store. RegionRequestSender uses the client's configured labels to
+// rank replicas by distance for stale reads.
+type StoreLabel struct {
+	Key   string
+	Value string
+}
+
+// serverBusyBackoffCap bounds how long we sleep in response to a
+// `ServerIsBusy` error carrying an `EstimatedWaitMs` hint, so that a store
+// reporting an unreasonably large estimate cannot stall a request forever.
+const serverBusyBackoffCap = 2 * time.Second
+
 // RegionRequestSender sends KV/Cop requests to tikv server. It handles network
 // errors and some region errors internally.
 //
@@ -44,20 +92,249 @@ type RegionRequestSender struct {
 	regionCache *RegionCache
 	client      Client
 	storeAddr   string
+
+	// excludeStores is peer-selection state that must survive across retries
+	// within a single SendReq call, so that a peer which has already failed
+	// or is known to be busy is not picked again.
+	excludeStores map[uint64]struct{}
+
+	// rpcError records the last genuine network-layer failure observed by
+	// onSendFail, i.e. one that is neither caller cancellation nor an
+	// application-level error that merely surfaced through gRPC. It is only
+	// set when isRPCError reports true, so callers can tell a sick store from
+	// a request that was always going to fail.
+	rpcError error
+
+	// stats collects per-RPC-type latency and retry counters for this
+	// sender, if the caller attached one via SetRuntimeStats. It is nil by
+	// default so requests that don't care about statistics pay no cost.
+	stats *RegionRequestRuntimeStats
+
+	// errorHandlers dispatches onRegionError by RegionErrorKind. It starts as
+	// a copy of defaultRegionErrorHandlers so that RegisterRegionErrorHandler
+	// can override an entry on this sender without affecting others.
+	errorHandlers map[RegionErrorKind]RegionErrorHandler
+
+	// replicaReadLabels are the client's configured locality labels (e.g.
+	// zone, rack, host), used to rank replicas by distance when a request
+	// has req.StaleRead set. Configure via SetReplicaReadLabels.
+	replicaReadLabels []StoreLabel
+
+	// deadline is the absolute time by which the current SendReqCtx call's
+	// overall timeout expires. It's set once per call so that in-loop
+	// backoffs with a sender-chosen duration, such as the ServerIsBusy
+	// wait, don't sleep past the overall budget even though their own cap
+	// (e.g. serverBusyBackoffCap) is larger than what's left of it.
+	deadline time.Time
+}
+
+// SetReplicaReadLabels configures the locality labels RegionCache uses to
+// rank replicas by distance for stale reads, e.g.
+// []StoreLabel{{Key: "zone", Value: "us-east-1a"}}.
+func (s *RegionRequestSender) SetReplicaReadLabels(labels []StoreLabel) {
+	s.replicaReadLabels = labels
+}
+
+// RPCRuntimeStats is the count and accumulated latency of one RPC type
+// (CmdGet, CmdPrewrite, CmdCoprocessor, ...).
+type RPCRuntimeStats struct {
+	Count int64
+	// Consume is the accumulated latency of this RPC type, in nanoseconds.
+	Consume int64
+}
+
+// RegionRequestRuntimeStats collects the runtime statistics of a
+// RegionRequestSender: per-RPC-type counts and latencies, region-error retry
+// counts by kind, and time spent in backoff by backoffType. An executor can
+// attach one via SetRuntimeStats, merge stats gathered across regions, and
+// surface them in EXPLAIN ANALYZE output. Since one instance is only ever
+// mutated by the sender it is attached to (never shared across senders), a
+// plain mutex keeps the hot path cheap without needing sharding.
+type RegionRequestRuntimeStats struct {
+	mu               sync.Mutex
+	RPCStats         map[tikvrpc.CmdType]*RPCRuntimeStats
+	RegionErrorStats map[string]int64
+	BackoffTimes     map[backoffType]time.Duration
+}
+
+// NewRegionRequestRuntimeStats creates an empty RegionRequestRuntimeStats.
+func NewRegionRequestRuntimeStats() *RegionRequestRuntimeStats {
+	return &RegionRequestRuntimeStats{
+		RPCStats:         make(map[tikvrpc.CmdType]*RPCRuntimeStats),
+		RegionErrorStats: make(map[string]int64),
+		BackoffTimes:     make(map[backoffType]time.Duration),
+	}
+}
+
+func (r *RegionRequestRuntimeStats) recordRPC(cmd tikvrpc.CmdType, consume time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	s := r.RPCStats[cmd]
+	if s == nil {
+		s = &RPCRuntimeStats{}
+		r.RPCStats[cmd] = s
+	}
+	s.Count++
+	s.Consume += int64(consume)
+}
+
+func (r *RegionRequestRuntimeStats) recordRegionError(kind string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.RegionErrorStats[kind]++
+}
+
+func (r *RegionRequestRuntimeStats) recordBackoff(bt backoffType, consume time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.BackoffTimes[bt] += consume
+}
+
+// Merge folds other's counters into r, e.g. when an executor combines stats
+// gathered while scanning multiple regions. Concurrent a.Merge(b) and
+// b.Merge(a) calls are safe: the snapshot below holds only other's lock,
+// never both locks at once, so the two calls can't AB-BA deadlock.
+func (r *RegionRequestRuntimeStats) Merge(other *RegionRequestRuntimeStats) {
+	if other == nil {
+		return
+	}
+	other.mu.Lock()
+	rpcStats := make(map[tikvrpc.CmdType]RPCRuntimeStats, len(other.RPCStats))
+	for cmd, s := range other.RPCStats {
+		rpcStats[cmd] = *s
+	}
+	regionErrorStats := make(map[string]int64, len(other.RegionErrorStats))
+	for kind, n := range other.RegionErrorStats {
+		regionErrorStats[kind] = n
+	}
+	backoffTimes := make(map[backoffType]time.Duration, len(other.BackoffTimes))
+	for bt, d := range other.BackoffTimes {
+		backoffTimes[bt] = d
+	}
+	other.mu.Unlock()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for cmd, s := range rpcStats {
+		dst := r.RPCStats[cmd]
+		if dst == nil {
+			dst = &RPCRuntimeStats{}
+			r.RPCStats[cmd] = dst
+		}
+		dst.Count += s.Count
+		dst.Consume += s.Consume
+	}
+	for kind, n := range regionErrorStats {
+		r.RegionErrorStats[kind] += n
+	}
+	for bt, d := range backoffTimes {
+		r.BackoffTimes[bt] += d
+	}
+}
+
+// SetRuntimeStats attaches stats to s; subsequent SendReq calls record into
+// it. Pass nil to stop collecting.
+func (s *RegionRequestSender) SetRuntimeStats(stats *RegionRequestRuntimeStats) {
+	s.stats = stats
+}
+
+// RPCError returns the last genuine network-layer failure observed by
+// onSendFail, or nil if none has occurred yet. See the rpcError field
+// comment for exactly which failures qualify.
+func (s *RegionRequestSender) RPCError() error {
+	return s.rpcError
 }
 
 // NewRegionRequestSender creates a new sender.
 func NewRegionRequestSender(regionCache *RegionCache, client Client) *RegionRequestSender {
+	errorHandlers := make(map[RegionErrorKind]RegionErrorHandler, len(defaultRegionErrorHandlers))
+	for kind, handler := range defaultRegionErrorHandlers {
+		errorHandlers[kind] = handler
+	}
 	return &RegionRequestSender{
-		regionCache: regionCache,
-		client:      client,
+		regionCache:   regionCache,
+		client:        client,
+		errorHandlers: errorHandlers,
 	}
 }
 
-// SendReq sends a request to tikv server.
+// TimeoutConfig splits a request's overall deadline from the timeout used for
+// each individual RPC attempt. It lets a caller (e.g. the session variable
+// `tidb_kv_read_timeout`) bound the overall time of SendReqCtx (see its doc
+// for which waits that covers) while still
+// failing fast on a single sick peer: the first attempt uses
+// FirstAttemptTimeout, and later attempts escalate towards whatever remains
+// of OverallTimeout.
+type TimeoutConfig struct {
+	OverallTimeout      time.Duration
+	FirstAttemptTimeout time.Duration
+}
+
+// attemptTimeout returns the per-try timeout to use for the given attempt
+// (0-indexed), capped by the remaining overall budget.
+func (c TimeoutConfig) attemptTimeout(attempt int, remaining time.Duration) time.Duration {
+	t := c.FirstAttemptTimeout
+	for i := 0; i < attempt; i++ {
+		t *= 2
+	}
+	if t <= 0 || t > c.OverallTimeout {
+		t = c.OverallTimeout
+	}
+	if t > remaining {
+		t = remaining
+	}
+	return t
+}
+
+// SendReq sends a request to tikv server with a single timeout that is used
+// both as the per-attempt and the overall budget. It is kept around,
+// unchanged in signature, for the existing callers (2pc, scanner,
+// coprocessor, lock resolver, ...); new callers that want the overall/
+// per-attempt split should use SendReqCtx instead.
 func (s *RegionRequestSender) SendReq(bo *Backoffer, req *tikvrpc.Request, regionID RegionVerID, timeout time.Duration) (*tikvrpc.Response, error) {
+	return s.SendReqCtx(bo, req, regionID, TimeoutConfig{OverallTimeout: timeout, FirstAttemptTimeout: timeout})
+}
+
+// SendReqCtx sends a request to tikv server. When req carries a replica-read
+// type other than ReplicaReadLeader, the peer is chosen among followers or
+// learners according to that policy instead of always targeting the leader.
+// When req.StaleRead is set, req.ReadTS must be non-zero; the request is then
+// routed to the nearest replica, ranked by s.replicaReadLabels (see
+// SetReplicaReadLabels), and if that replica's safe-ts has not caught up
+// with ReadTS, the DataIsNotReady handler falls the request back to the
+// leader automatically.
+//
+// timeout.OverallTimeout is checked before each attempt and caps every RPC
+// attempt and the ServerIsBusy wait; a backoff run through bo is not cut
+// short at OverallTimeout, so a call can return up to one such backoff after
+// it. timeout.FirstAttemptTimeout bounds only the first RPC attempt, with
+// later attempts escalating towards the overall budget.
+func (s *RegionRequestSender) SendReqCtx(bo *Backoffer, req *tikvrpc.Request, regionID RegionVerID, timeout TimeoutConfig) (*tikvrpc.Response, error) {
+	if req.StaleRead && req.ReadTS == 0 {
+		return nil, errors.New("stale read requires a non-zero ReadTS")
+	}
+	s.excludeStores = make(map[uint64]struct{})
+	deadline := time.Now().Add(timeout.OverallTimeout)
+	s.deadline = deadline
+	// rpcAttempt only counts RPCs actually sent to a peer; it's what
+	// TimeoutConfig.attemptTimeout escalates on. Skipping a busy peer below
+	// never calls sendReqToRegion, so it must not advance rpcAttempt, or
+	// the first real RPC of a request that skipped N busy peers would start
+	// at an already-escalated timeout instead of FirstAttemptTimeout.
+	rpcAttempt := 0
 	for {
-		ctx, err := s.regionCache.GetRPCContext(bo, regionID)
+		remaining := deadline.Sub(time.Now())
+		if remaining <= 0 {
+			return nil, errors.Errorf("kv request exceeded overall timeout %s", timeout.OverallTimeout)
+		}
+
+		var ctx *RPCContext
+		var err error
+		if req.StaleRead {
+			ctx, err = s.regionCache.GetNearestRPCContext(bo, regionID, req.ReadTS, s.replicaReadLabels, s.excludeStores)
+		} else {
+			ctx, err = s.regionCache.GetRPCContext(bo, regionID, req.ReplicaReadType, s.excludeStores)
+		}
 		if err != nil {
 			return nil, errors.Trace(err)
 		}
@@ -71,8 +348,18 @@ func (s *RegionRequestSender) SendReq(bo *Backoffer, req *tikvrpc.Request, regio
 			return tikvrpc.GenRegionErrorResp(req, &errorpb.Error{StaleEpoch: &errorpb.StaleEpoch{}})
 		}
 
+		if req.ReplicaReadType != ReplicaReadLeader {
+			// Prefer a replica that isn't already reporting heavy load
+			// instead of discovering it only after a ServerIsBusy response.
+			if wait := ctx.Store.EstimatedWaitTime(); wait > serverBusyBackoffCap {
+				s.excludeStores[ctx.Peer.GetStoreId()] = struct{}{}
+				continue
+			}
+		}
+
 		s.storeAddr = ctx.Addr
-		resp, retry, err := s.sendReqToRegion(bo, ctx, req, timeout)
+		resp, retry, err := s.sendReqToRegion(bo, ctx, req, timeout.attemptTimeout(rpcAttempt, remaining))
+		rpcAttempt++
 		if err != nil {
 			return nil, errors.Trace(err)
 		}
@@ -85,7 +372,7 @@ func (s *RegionRequestSender) SendReq(bo *Backoffer, req *tikvrpc.Request, regio
 			return nil, errors.Trace(err)
 		}
 		if regionErr != nil {
-			retry, err := s.onRegionError(bo, ctx, regionErr)
+			retry, err := s.onRegionError(bo, ctx, req, regionErr)
 			if err != nil {
 				return nil, errors.Trace(err)
 			}
@@ -93,6 +380,9 @@ func (s *RegionRequestSender) SendReq(bo *Backoffer, req *tikvrpc.Request, regio
 				continue
 			}
 		}
+		if req.StaleRead {
+			atomic.AddInt64(&staleReadHitCounter, 1)
+		}
 		return resp, nil
 	}
 }
@@ -103,7 +393,11 @@ func (s *RegionRequestSender) sendReqToRegion(bo *Backoffer, ctx *RPCContext, re
 	}
 	context, cancel := goctx.WithTimeout(bo.ctx, timeout)
 	defer cancel()
+	start := time.Now()
 	resp, err = s.client.SendReq(context, ctx.Addr, req)
+	if s.stats != nil {
+		s.stats.recordRPC(req.Type, time.Since(start))
+	}
 	if err != nil {
 		if e := s.onSendFail(bo, ctx, err); e != nil {
 			return nil, false, errors.Trace(e)
@@ -113,67 +407,357 @@ func (s *RegionRequestSender) sendReqToRegion(bo *Backoffer, ctx *RPCContext, re
 	return
 }
 
+// sendFailKind classifies why an RPC attempt failed, so onSendFail can tell a
+// genuine network/store problem from caller cancellation or an
+// application-level error that merely surfaced through gRPC.
+type sendFailKind int
+
+const (
+	sendFailCallerCanceled sendFailKind = iota
+	sendFailDeadlineExceeded
+	sendFailTransientNetwork
+	sendFailGRPCUnavailable
+	sendFailGRPCAppError
+)
+
+// classifySendFail inspects err returned by the RPC client and buckets it
+// into a sendFailKind.
+func classifySendFail(err error) sendFailKind {
+	cause := errors.Cause(err)
+	if cause == goctx.Canceled || grpc.Code(err) == codes.Canceled {
+		return sendFailCallerCanceled
+	}
+	if cause == goctx.DeadlineExceeded || grpc.Code(err) == codes.DeadlineExceeded {
+		return sendFailDeadlineExceeded
+	}
+	switch grpc.Code(err) {
+	case codes.Unavailable:
+		return sendFailGRPCUnavailable
+	case codes.ResourceExhausted, codes.PermissionDenied, codes.Unauthenticated, codes.InvalidArgument:
+		// These codes mean the request reached the server and was rejected
+		// for an application-level reason (e.g. a resource-group/quota
+		// error), not because the store or leader is unhealthy.
+		return sendFailGRPCAppError
+	}
+	return sendFailTransientNetwork
+}
+
+// isRPCError reports whether err represents a genuine network-layer failure,
+// as opposed to caller cancellation or an application-level error that
+// merely surfaced through gRPC. Only these failures should count against a
+// store/leader in RegionCache.
+func isRPCError(err error) bool {
+	kind := classifySendFail(err)
+	return kind == sendFailTransientNetwork || kind == sendFailGRPCUnavailable
+}
+
 func (s *RegionRequestSender) onSendFail(bo *Backoffer, ctx *RPCContext, err error) error {
-	// If it failed because the context is canceled, don't retry on this error.
-	if errors.Cause(err) == goctx.Canceled || grpc.Code(err) == codes.Canceled {
+	kind := classifySendFail(err)
+	switch kind {
+	case sendFailCallerCanceled:
+		// The caller's own context was canceled, don't retry on this error.
+		return errors.Trace(err)
+	case sendFailDeadlineExceeded:
+		// The per-attempt timeout expired. Since it is capped by what is
+		// left of the overall budget, the budget may have run out too; the
+		// loop in SendReqCtx checks that before the next attempt. The store
+		// is not necessarily unhealthy, so fall back to another replica for
+		// this SendReq call instead of invalidating the leader.
+		s.excludeStores[ctx.Peer.GetStoreId()] = struct{}{}
+		return nil
+	case sendFailGRPCAppError:
+		// The request reached the server; the failure is not a transport
+		// problem, so leave the leader cache untouched and surface the
+		// error directly instead of retrying.
 		return errors.Trace(err)
 	}
 
+	if isRPCError(err) {
+		s.rpcError = err
+	}
 	s.regionCache.OnRequestFail(ctx)
 
 	// Retry on request failure when it's not canceled.
 	// When a store is not available, the leader of related region should be elected quickly.
 	// TODO: the number of retry time should be limited:since region may be unavailable
 	// when some unrecoverable disaster happened.
-	err = bo.Backoff(boTiKVRPC, errors.Errorf("send tikv request error: %v, ctx: %s, try next peer later", err, ctx.KVCtx))
+	err = s.backoffWithStats(bo, boTiKVRPC, errors.Errorf("send tikv request error: %v, ctx: %s, try next peer later", err, ctx.KVCtx))
 	return errors.Trace(err)
 }
 
-func (s *RegionRequestSender) onRegionError(bo *Backoffer, ctx *RPCContext, regionErr *errorpb.Error) (retry bool, err error) {
-	reportRegionError(regionErr)
-	if notLeader := regionErr.GetNotLeader(); notLeader != nil {
-		// Retry if error is `NotLeader`.
+// backoffWithStats wraps bo.Backoff so that the time spent backing off is
+// recorded into s.stats, if one is attached.
+func (s *RegionRequestSender) backoffWithStats(bo *Backoffer, bt backoffType, reason error) error {
+	start := time.Now()
+	err := bo.Backoff(bt, reason)
+	if s.stats != nil {
+		s.stats.recordBackoff(bt, time.Since(start))
+	}
+	return err
+}
+
+// sleepWithBackoffer waits for wait, like every other wait path in this
+// file, but returns as soon as bo's context is canceled or deadline-exceeded
+// instead of always blocking for the full duration, and records the elapsed
+// time into s.stats under bt.
+func (s *RegionRequestSender) sleepWithBackoffer(bo *Backoffer, bt backoffType, wait time.Duration) error {
+	start := time.Now()
+	var err error
+	select {
+	case <-time.After(wait):
+	case <-bo.ctx.Done():
+		err = bo.ctx.Err()
+	}
+	if s.stats != nil {
+		s.stats.recordBackoff(bt, time.Since(start))
+	}
+	return errors.Trace(err)
+}
+
+// RegionErrorKind identifies which variant of errorpb.Error a
+// RegionErrorHandler reacts to.
+type RegionErrorKind int
+
+const (
+	KindNotLeader RegionErrorKind = iota
+	KindStoreNotMatch
+	KindStaleEpoch
+	KindServerIsBusy
+	KindStaleCommand
+	KindRaftEntryTooLarge
+	KindDataIsNotReady
+	KindFlashbackInProgress
+	KindMaxTimestampNotSynced
+	KindReadIndexNotReady
+	KindProposalInMergingMode
+	kindOther
+)
+
+// String returns the name used for logging and as a RegionRequestRuntimeStats key.
+func (k RegionErrorKind) String() string {
+	switch k {
+	case KindNotLeader:
+		return "NotLeader"
+	case KindStoreNotMatch:
+		return "StoreNotMatch"
+	case KindStaleEpoch:
+		return "StaleEpoch"
+	case KindServerIsBusy:
+		return "ServerIsBusy"
+	case KindStaleCommand:
+		return "StaleCommand"
+	case KindRaftEntryTooLarge:
+		return "RaftEntryTooLarge"
+	case KindDataIsNotReady:
+		return "DataIsNotReady"
+	case KindFlashbackInProgress:
+		return "FlashbackInProgress"
+	case KindMaxTimestampNotSynced:
+		return "MaxTimestampNotSynced"
+	case KindReadIndexNotReady:
+		return "ReadIndexNotReady"
+	case KindProposalInMergingMode:
+		return "ProposalInMergingMode"
+	default:
+		return "Other"
+	}
+}
+
+// classifyRegionError returns which variant of regionErr is set.
+func classifyRegionError(regionErr *errorpb.Error) RegionErrorKind {
+	switch {
+	case regionErr.GetDataIsNotReady() != nil:
+		return KindDataIsNotReady
+	case regionErr.GetNotLeader() != nil:
+		return KindNotLeader
+	case regionErr.GetStoreNotMatch() != nil:
+		return KindStoreNotMatch
+	case regionErr.GetStaleEpoch() != nil:
+		return KindStaleEpoch
+	case regionErr.GetServerIsBusy() != nil:
+		return KindServerIsBusy
+	case regionErr.GetStaleCommand() != nil:
+		return KindStaleCommand
+	case regionErr.GetRaftEntryTooLarge() != nil:
+		return KindRaftEntryTooLarge
+	case regionErr.GetFlashbackInProgress() != nil:
+		return KindFlashbackInProgress
+	case regionErr.GetMaxTimestampNotSynced() != nil:
+		return KindMaxTimestampNotSynced
+	case regionErr.GetReadIndexNotReady() != nil:
+		return KindReadIndexNotReady
+	case regionErr.GetProposalInMergingMode() != nil:
+		return KindProposalInMergingMode
+	default:
+		return kindOther
+	}
+}
+
+// RegionErrorHandler reacts to one variant of errorpb.Error observed while
+// processing a region request. retry tells SendReq whether to resend the
+// request to (possibly) the same region; dropRegion tells it to evict the
+// region from RegionCache so the caller re-splits and re-routes the request.
+type RegionErrorHandler interface {
+	Handle(s *RegionRequestSender, bo *Backoffer, ctx *RPCContext, req *tikvrpc.Request, regionErr *errorpb.Error) (retry bool, dropRegion bool, err error)
+}
+
+// RegionErrorHandlerFunc adapts a plain function to a RegionErrorHandler.
+type RegionErrorHandlerFunc func(s *RegionRequestSender, bo *Backoffer, ctx *RPCContext, req *tikvrpc.Request, regionErr *errorpb.Error) (bool, bool, error)
+
+// Handle implements RegionErrorHandler.
+func (f RegionErrorHandlerFunc) Handle(s *RegionRequestSender, bo *Backoffer, ctx *RPCContext, req *tikvrpc.Request, regionErr *errorpb.Error) (bool, bool, error) {
+	return f(s, bo, ctx, req, regionErr)
+}
+
+// defaultRegionErrorHandlers holds the built-in handling for every
+// errorpb.Error variant RegionRequestSender knows about. RegionRequestSender
+// copies this map on construction so RegisterRegionErrorHandler can override
+// an entry per-sender without affecting other senders.
+var defaultRegionErrorHandlers = map[RegionErrorKind]RegionErrorHandler{
+	KindDataIsNotReady: RegionErrorHandlerFunc(func(s *RegionRequestSender, bo *Backoffer, ctx *RPCContext, req *tikvrpc.Request, regionErr *errorpb.Error) (bool, bool, error) {
+		// The replica's safe-ts has not caught up with ReadTS yet. Fall back
+		// to the leader for a strongly consistent read instead of dropping
+		// the region, since the region itself is healthy.
+		log.Warnf("tikv reports `DataIsNotReady`, ctx: %s, safe-ts is lagging, fallback to leader", ctx.KVCtx)
+		atomic.AddInt64(&staleReadFallbackCounter, 1)
+		req.StaleRead = false
+		req.ReplicaReadType = ReplicaReadLeader
+		return true, false, nil
+	}),
+	KindNotLeader: RegionErrorHandlerFunc(func(s *RegionRequestSender, bo *Backoffer, ctx *RPCContext, req *tikvrpc.Request, regionErr *errorpb.Error) (bool, bool, error) {
+		notLeader := regionErr.GetNotLeader()
 		log.Debugf("tikv reports `NotLeader`: %s, ctx: %s, retry later", notLeader, ctx.KVCtx)
 		s.regionCache.UpdateLeader(ctx.Region, notLeader.GetLeader().GetStoreId())
 		if notLeader.GetLeader() == nil {
-			err = bo.Backoff(boRegionMiss, errors.Errorf("not leader: %v, ctx: %s", notLeader, ctx.KVCtx))
-			if err != nil {
-				return false, errors.Trace(err)
+			if err := s.backoffWithStats(bo, boRegionMiss, errors.Errorf("not leader: %v, ctx: %s", notLeader, ctx.KVCtx)); err != nil {
+				return false, false, errors.Trace(err)
 			}
 		}
-		return true, nil
-	}
-
-	if storeNotMatch := regionErr.GetStoreNotMatch(); storeNotMatch != nil {
-		// store not match
+		return true, false, nil
+	}),
+	KindStoreNotMatch: RegionErrorHandlerFunc(func(s *RegionRequestSender, bo *Backoffer, ctx *RPCContext, req *tikvrpc.Request, regionErr *errorpb.Error) (bool, bool, error) {
+		storeNotMatch := regionErr.GetStoreNotMatch()
 		log.Warnf("tikv reports `StoreNotMatch`: %s, ctx: %s, retry later", storeNotMatch, ctx.KVCtx)
 		s.regionCache.ClearStoreByID(ctx.GetStoreID())
-		return true, nil
-	}
-
-	if staleEpoch := regionErr.GetStaleEpoch(); staleEpoch != nil {
+		return true, false, nil
+	}),
+	KindStaleEpoch: RegionErrorHandlerFunc(func(s *RegionRequestSender, bo *Backoffer, ctx *RPCContext, req *tikvrpc.Request, regionErr *errorpb.Error) (bool, bool, error) {
+		staleEpoch := regionErr.GetStaleEpoch()
 		log.Debugf("tikv reports `StaleEpoch`, ctx: %s, retry later", ctx.KVCtx)
-		err = s.regionCache.OnRegionStale(ctx, staleEpoch.NewRegions)
-		return false, errors.Trace(err)
-	}
-	if regionErr.GetServerIsBusy() != nil {
-		log.Warnf("tikv reports `ServerIsBusy`, reason: %s, ctx: %s, retry later", regionErr.GetServerIsBusy().GetReason(), ctx.KVCtx)
-		err = bo.Backoff(boServerBusy, errors.Errorf("server is busy, ctx: %s", ctx.KVCtx))
-		if err != nil {
-			return false, errors.Trace(err)
+		err := s.regionCache.OnRegionStale(ctx, staleEpoch.NewRegions)
+		return false, false, errors.Trace(err)
+	}),
+	KindServerIsBusy: RegionErrorHandlerFunc(func(s *RegionRequestSender, bo *Backoffer, ctx *RPCContext, req *tikvrpc.Request, regionErr *errorpb.Error) (bool, bool, error) {
+		serverIsBusy := regionErr.GetServerIsBusy()
+		log.Warnf("tikv reports `ServerIsBusy`, reason: %s, ctx: %s, retry later", serverIsBusy.GetReason(), ctx.KVCtx)
+		// A busy peer does not necessarily mean the region is unhealthy, so we
+		// only exclude that peer and retry against another one in the same
+		// region instead of dropping the region from cache.
+		s.excludeStores[ctx.Peer.GetStoreId()] = struct{}{}
+		if waitMs := serverIsBusy.GetEstimatedWaitMs(); waitMs > 0 {
+			ctx.Store.updateLoadStats(time.Duration(waitMs) * time.Millisecond)
 		}
-		return true, nil
-	}
-	if regionErr.GetStaleCommand() != nil {
+		if wait := ctx.Store.EstimatedWaitTime(); wait > 0 {
+			if wait > serverBusyBackoffCap {
+				wait = serverBusyBackoffCap
+			}
+			// Don't let this sleep outlast the request's own overall
+			// timeout; the caller would otherwise block well past the
+			// budget it asked for before the attempt loop's next
+			// remaining <= 0 check finally gives up.
+			if remaining := s.deadline.Sub(time.Now()); wait > remaining {
+				if remaining < 0 {
+					remaining = 0
+				}
+				wait = remaining
+			}
+			if err := s.sleepWithBackoffer(bo, boServerBusy, wait); err != nil {
+				return false, false, errors.Trace(err)
+			}
+			return true, false, nil
+		}
+		if err := s.backoffWithStats(bo, boServerBusy, errors.Errorf("server is busy, ctx: %s", ctx.KVCtx)); err != nil {
+			return false, false, errors.Trace(err)
+		}
+		return true, false, nil
+	}),
+	KindStaleCommand: RegionErrorHandlerFunc(func(s *RegionRequestSender, bo *Backoffer, ctx *RPCContext, req *tikvrpc.Request, regionErr *errorpb.Error) (bool, bool, error) {
 		log.Debugf("tikv reports `StaleCommand`, ctx: %s", ctx.KVCtx)
-		return true, nil
-	}
-	if regionErr.GetRaftEntryTooLarge() != nil {
+		return true, false, nil
+	}),
+	KindRaftEntryTooLarge: RegionErrorHandlerFunc(func(s *RegionRequestSender, bo *Backoffer, ctx *RPCContext, req *tikvrpc.Request, regionErr *errorpb.Error) (bool, bool, error) {
 		log.Warnf("tikv reports `RaftEntryTooLarge`, ctx: %s", ctx.KVCtx)
-		return false, errors.New(regionErr.String())
+		return false, false, errors.New(regionErr.String())
+	}),
+	KindFlashbackInProgress: RegionErrorHandlerFunc(func(s *RegionRequestSender, bo *Backoffer, ctx *RPCContext, req *tikvrpc.Request, regionErr *errorpb.Error) (bool, bool, error) {
+		log.Warnf("tikv reports `FlashbackInProgress`, ctx: %s", ctx.KVCtx)
+		return false, false, errors.Errorf("region is in flashback progress, ctx: %s", ctx.KVCtx)
+	}),
+	KindMaxTimestampNotSynced: RegionErrorHandlerFunc(func(s *RegionRequestSender, bo *Backoffer, ctx *RPCContext, req *tikvrpc.Request, regionErr *errorpb.Error) (bool, bool, error) {
+		log.Warnf("tikv reports `MaxTimestampNotSynced`, ctx: %s, retry later", ctx.KVCtx)
+		if err := s.backoffWithStats(bo, boMaxTsNotSynced, errors.Errorf("max timestamp not synced, ctx: %s", ctx.KVCtx)); err != nil {
+			return false, false, errors.Trace(err)
+		}
+		return true, false, nil
+	}),
+	KindReadIndexNotReady: RegionErrorHandlerFunc(func(s *RegionRequestSender, bo *Backoffer, ctx *RPCContext, req *tikvrpc.Request, regionErr *errorpb.Error) (bool, bool, error) {
+		log.Debugf("tikv reports `ReadIndexNotReady`, ctx: %s, retry later", ctx.KVCtx)
+		if err := s.backoffWithStats(bo, boRegionMiss, errors.Errorf("read index not ready, ctx: %s", ctx.KVCtx)); err != nil {
+			return false, false, errors.Trace(err)
+		}
+		return true, false, nil
+	}),
+	KindProposalInMergingMode: RegionErrorHandlerFunc(func(s *RegionRequestSender, bo *Backoffer, ctx *RPCContext, req *tikvrpc.Request, regionErr *errorpb.Error) (bool, bool, error) {
+		log.Debugf("tikv reports `ProposalInMergingMode`, ctx: %s, retry later", ctx.KVCtx)
+		if err := s.backoffWithStats(bo, boRegionMiss, errors.Errorf("region is merging, ctx: %s", ctx.KVCtx)); err != nil {
+			return false, false, errors.Trace(err)
+		}
+		return true, false, nil
+	}),
+}
+
+// RegisterRegionErrorHandler overrides the handler used for a given
+// errorpb.Error kind on s, letting downstream users (CDC, BR) customize
+// region-error behavior without forking RegionRequestSender. It is safe to
+// call on a RegionRequestSender built as a struct literal, without going
+// through NewRegionRequestSender.
+func (s *RegionRequestSender) RegisterRegionErrorHandler(kind RegionErrorKind, handler RegionErrorHandler) {
+	if s.errorHandlers == nil {
+		s.errorHandlers = make(map[RegionErrorKind]RegionErrorHandler, len(defaultRegionErrorHandlers))
+		for k, h := range defaultRegionErrorHandlers {
+			s.errorHandlers[k] = h
+		}
+	}
+	s.errorHandlers[kind] = handler
+}
+
+func (s *RegionRequestSender) onRegionError(bo *Backoffer, ctx *RPCContext, req *tikvrpc.Request, regionErr *errorpb.Error) (retry bool, err error) {
+	reportRegionError(regionErr)
+	kind := classifyRegionError(regionErr)
+	if s.stats != nil {
+		s.stats.recordRegionError(kind.String())
+	}
+
+	// s.errorHandlers is nil for a RegionRequestSender built as a struct
+	// literal rather than via NewRegionRequestSender; fall back to the
+	// package defaults so such a sender still retries NotLeader,
+	// ServerIsBusy, StoreNotMatch, etc. and still refreshes the cache on
+	// StaleEpoch, instead of silently dropping the region on every error.
+	handlers := s.errorHandlers
+	if handlers == nil {
+		handlers = defaultRegionErrorHandlers
 	}
-	// For other errors, we only drop cache here.
-	// Because caller may need to re-split the request.
+
+	if handler, ok := handlers[kind]; ok {
+		retry, dropRegion, err := handler.Handle(s, bo, ctx, req, regionErr)
+		if dropRegion {
+			s.regionCache.DropRegion(ctx.Region)
+		}
+		return retry, errors.Trace(err)
+	}
+
+	// For errors with no registered handler, we only drop cache here, since
+	// the caller may need to re-split the request.
 	log.Debugf("tikv reports region error: %s, ctx: %s", regionErr, ctx.KVCtx)
 	s.regionCache.DropRegion(ctx.Region)
 	return false, nil
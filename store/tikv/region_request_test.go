@@ -0,0 +1,186 @@
+// Copyright 2016 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tikv
+
+import (
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/pingcap/kvproto/pkg/errorpb"
+	"github.com/pingcap/tidb/store/tikv/tikvrpc"
+	goctx "golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+)
+
+func TestTimeoutConfigAttemptTimeout(t *testing.T) {
+	cfg := TimeoutConfig{OverallTimeout: 2 * time.Second, FirstAttemptTimeout: 100 * time.Millisecond}
+	cases := []struct {
+		attempt   int
+		remaining time.Duration
+		want      time.Duration
+	}{
+		{0, 2 * time.Second, 100 * time.Millisecond},
+		{1, 2 * time.Second, 200 * time.Millisecond},
+		{2, 2 * time.Second, 400 * time.Millisecond},
+		// Escalation eventually exceeds OverallTimeout and clamps to it.
+		{5, 2 * time.Second, 2 * time.Second},
+		// The remaining budget is smaller than the first-attempt timeout.
+		{0, 50 * time.Millisecond, 50 * time.Millisecond},
+	}
+	for _, c := range cases {
+		if got := cfg.attemptTimeout(c.attempt, c.remaining); got != c.want {
+			t.Errorf("attemptTimeout(%d, %s) = %s, want %s", c.attempt, c.remaining, got, c.want)
+		}
+	}
+}
+
+func TestClassifySendFail(t *testing.T) {
+	cases := []struct {
+		name string
+		err  error
+		want sendFailKind
+	}{
+		{"caller canceled context", errors.Trace(goctx.Canceled), sendFailCallerCanceled},
+		{"grpc canceled code", grpc.Errorf(codes.Canceled, "canceled"), sendFailCallerCanceled},
+		{"deadline exceeded", errors.Trace(goctx.DeadlineExceeded), sendFailDeadlineExceeded},
+		{"grpc deadline exceeded", grpc.Errorf(codes.DeadlineExceeded, "deadline exceeded"), sendFailDeadlineExceeded},
+		{"grpc unavailable", grpc.Errorf(codes.Unavailable, "unavailable"), sendFailGRPCUnavailable},
+		{"grpc resource exhausted", grpc.Errorf(codes.ResourceExhausted, "exhausted"), sendFailGRPCAppError},
+		{"grpc permission denied", grpc.Errorf(codes.PermissionDenied, "denied"), sendFailGRPCAppError},
+		{"grpc unauthenticated", grpc.Errorf(codes.Unauthenticated, "unauthenticated"), sendFailGRPCAppError},
+		{"grpc invalid argument", grpc.Errorf(codes.InvalidArgument, "invalid"), sendFailGRPCAppError},
+		{"plain network error", errors.New("connection refused"), sendFailTransientNetwork},
+	}
+	for _, c := range cases {
+		if got := classifySendFail(c.err); got != c.want {
+			t.Errorf("%s: classifySendFail() = %v, want %v", c.name, got, c.want)
+		}
+	}
+}
+
+func TestIsRPCError(t *testing.T) {
+	cases := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"caller canceled", errors.Trace(goctx.Canceled), false},
+		{"deadline exceeded", errors.Trace(goctx.DeadlineExceeded), false},
+		{"grpc app error", grpc.Errorf(codes.InvalidArgument, "invalid"), false},
+		{"grpc unavailable", grpc.Errorf(codes.Unavailable, "unavailable"), true},
+		{"transient network error", errors.New("connection refused"), true},
+	}
+	for _, c := range cases {
+		if got := isRPCError(c.err); got != c.want {
+			t.Errorf("%s: isRPCError() = %v, want %v", c.name, got, c.want)
+		}
+	}
+}
+
+func funcPointer(h RegionErrorHandler) uintptr {
+	return reflect.ValueOf(h).Pointer()
+}
+
+func TestRegisterRegionErrorHandlerOverride(t *testing.T) {
+	// A sender built as a struct literal, bypassing NewRegionRequestSender,
+	// starts with a nil errorHandlers map.
+	s := &RegionRequestSender{}
+	if s.errorHandlers != nil {
+		t.Fatalf("expected a zero-value RegionRequestSender to have nil errorHandlers")
+	}
+
+	custom := RegionErrorHandlerFunc(func(s *RegionRequestSender, bo *Backoffer, ctx *RPCContext, req *tikvrpc.Request, regionErr *errorpb.Error) (bool, bool, error) {
+		return false, true, nil
+	})
+	s.RegisterRegionErrorHandler(KindNotLeader, custom)
+
+	if s.errorHandlers == nil {
+		t.Fatalf("RegisterRegionErrorHandler did not lazily initialize errorHandlers")
+	}
+	if got, want := funcPointer(s.errorHandlers[KindNotLeader]), funcPointer(custom); got != want {
+		t.Errorf("errorHandlers[KindNotLeader] was not overridden with the registered handler")
+	}
+	if len(s.errorHandlers) != len(defaultRegionErrorHandlers) {
+		t.Errorf("RegisterRegionErrorHandler should seed every default kind, got %d want %d", len(s.errorHandlers), len(defaultRegionErrorHandlers))
+	}
+	for kind, handler := range defaultRegionErrorHandlers {
+		if kind == KindNotLeader {
+			continue
+		}
+		if got, want := funcPointer(s.errorHandlers[kind]), funcPointer(handler); got != want {
+			t.Errorf("errorHandlers[%s] should still be the package default after overriding only KindNotLeader", kind)
+		}
+	}
+
+	// The package-level defaults must not have been mutated by the override.
+	if got, want := funcPointer(defaultRegionErrorHandlers[KindNotLeader]), funcPointer(custom); got == want {
+		t.Errorf("RegisterRegionErrorHandler leaked the override into the shared defaultRegionErrorHandlers map")
+	}
+}
+
+func TestStaleReadCounters(t *testing.T) {
+	hitBefore, fallbackBefore := StaleReadCounters()
+
+	atomic.AddInt64(&staleReadHitCounter, 3)
+	atomic.AddInt64(&staleReadFallbackCounter, 1)
+
+	hitAfter, fallbackAfter := StaleReadCounters()
+	if got, want := hitAfter-hitBefore, int64(3); got != want {
+		t.Errorf("StaleReadCounters() hit delta = %d, want %d", got, want)
+	}
+	if got, want := fallbackAfter-fallbackBefore, int64(1); got != want {
+		t.Errorf("StaleReadCounters() fallback delta = %d, want %d", got, want)
+	}
+}
+
+// TestRegionRequestRuntimeStatsMergeConcurrent guards against the AB-BA
+// deadlock that a naive Merge, which locks other then r, would hit when two
+// goroutines call a.Merge(b) and b.Merge(a) at the same time.
+func TestRegionRequestRuntimeStatsMergeConcurrent(t *testing.T) {
+	a := NewRegionRequestRuntimeStats()
+	b := NewRegionRequestRuntimeStats()
+	a.recordRPC(tikvrpc.CmdGet, time.Millisecond)
+	b.recordRPC(tikvrpc.CmdGet, time.Millisecond)
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 1000; i++ {
+			a.Merge(b)
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 1000; i++ {
+			b.Merge(a)
+		}
+	}()
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("a.Merge(b) and b.Merge(a) deadlocked")
+	}
+}